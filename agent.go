@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+)
+
+// agentHeartbeatTTL is how long an agent can go without re-registering
+// before it is considered dead and evicted, so a crashed agent doesn't
+// linger in the scheduler forever still eligible to claim jobs.
+const agentHeartbeatTTL = 90 * time.Second
+
+// Agent is a remote saturated-agent process registered with the
+// scheduler, advertising labels (arch, kernel, gpu, ...) and how many
+// builds it is willing to run concurrently.
+type Agent struct {
+	ID          string
+	Labels      map[string]string
+	Concurrency int
+
+	lastHeartbeat time.Time
+}
+
+// Job is a queued build waiting to be claimed by a matching agent. Once
+// claimed, the coordinator looks it up by ID to proxy the agent's log
+// upload and to receive its result.
+type Job struct {
+	ID             string            `json:"id"`
+	RepoURL        string            `json:"repo_url"`
+	BranchName     string            `json:"branch"`
+	BuildCommand   string            `json:"build_command"`
+	InstallCommand string            `json:"install_command"`
+	Environ        []string          `json:"environ"`
+	Labels         map[string]string `json:"labels"`
+
+	logger io.WriteCloser
+	done   chan error
+
+	agentID string
+}
+
+// AgentScheduler tracks registered agents and the queue of builds
+// waiting to be claimed, matching each job's requested labels (glob
+// patterns) against what an agent advertised at registration.
+type AgentScheduler struct {
+	token string
+
+	mutex   sync.Mutex
+	agents  map[string]*Agent
+	queue   []*Job
+	claimed map[string]*Job
+	active  map[string]int
+	counter int64
+}
+
+func NewAgentScheduler(token string) *AgentScheduler {
+	return &AgentScheduler{
+		token:   token,
+		agents:  map[string]*Agent{},
+		claimed: map[string]*Job{},
+		active:  map[string]int{},
+	}
+}
+
+func (scheduler *AgentScheduler) Authenticate(token string) bool {
+	return scheduler.token != "" && token == scheduler.token
+}
+
+func (scheduler *AgentScheduler) Register(agent *Agent) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	agent.lastHeartbeat = time.Now()
+	scheduler.agents[agent.ID] = agent
+}
+
+// Enqueue adds a job to the queue, assigning it an ID agents will use
+// to address the log upload and result endpoints.
+func (scheduler *AgentScheduler) Enqueue(job *Job) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.counter++
+	job.ID = fmt.Sprintf("%d", scheduler.counter)
+
+	scheduler.queue = append(scheduler.queue, job)
+}
+
+// Claim blocks, polling the queue, until a job matching the agent's
+// labels is available or timeout elapses, in which case it returns nil.
+func (scheduler *AgentScheduler) Claim(agentID string, timeout time.Duration) *Job {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		job := scheduler.tryClaim(agentID)
+		if job != nil {
+			return job
+		}
+
+		if time.Now().After(deadline) {
+			return nil
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+func (scheduler *AgentScheduler) tryClaim(agentID string) *Job {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.pruneStaleAgents()
+
+	agent, ok := scheduler.agents[agentID]
+	if !ok {
+		return nil
+	}
+
+	if agent.Concurrency > 0 && scheduler.active[agentID] >= agent.Concurrency {
+		return nil
+	}
+
+	for i, job := range scheduler.queue {
+		if !labelsMatch(agent.Labels, job.Labels) {
+			continue
+		}
+
+		scheduler.queue = append(scheduler.queue[:i:i], scheduler.queue[i+1:]...)
+		job.agentID = agentID
+		scheduler.claimed[job.ID] = job
+		scheduler.active[agentID]++
+
+		return job
+	}
+
+	return nil
+}
+
+// pruneStaleAgents evicts agents that haven't re-registered within
+// agentHeartbeatTTL. Called with the mutex already held.
+func (scheduler *AgentScheduler) pruneStaleAgents() {
+	now := time.Now()
+
+	for id, agent := range scheduler.agents {
+		if now.Sub(agent.lastHeartbeat) > agentHeartbeatTTL {
+			delete(scheduler.agents, id)
+		}
+	}
+}
+
+// Job returns the claimed job with the given ID, or nil if it is
+// unknown or already finished.
+func (scheduler *AgentScheduler) Job(id string) *Job {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	return scheduler.claimed[id]
+}
+
+// Expire removes a job that timed out waiting for an agent to claim or
+// finish it, from wherever it currently sits (still queued, or claimed
+// by an agent that never reported back), so it doesn't count against
+// that agent's concurrency limit or get handed out after its client has
+// already given up.
+func (scheduler *AgentScheduler) Expire(job *Job) {
+	scheduler.mutex.Lock()
+
+	removed := false
+	for i, queued := range scheduler.queue {
+		if queued == job {
+			scheduler.queue = append(scheduler.queue[:i:i], scheduler.queue[i+1:]...)
+			removed = true
+			break
+		}
+	}
+
+	if !removed {
+		if _, ok := scheduler.claimed[job.ID]; ok {
+			delete(scheduler.claimed, job.ID)
+			scheduler.active[job.agentID]--
+			removed = true
+		}
+	}
+
+	scheduler.mutex.Unlock()
+
+	if removed && job.logger != nil {
+		job.logger.Close()
+	}
+}
+
+// Finish removes a completed job from the claimed set and closes its
+// logger, flushing whatever partial, not-yet-newline-terminated line of
+// the agent's log upload is still buffered.
+func (scheduler *AgentScheduler) Finish(id string) {
+	scheduler.mutex.Lock()
+	job, ok := scheduler.claimed[id]
+	if ok {
+		delete(scheduler.claimed, id)
+		scheduler.active[job.agentID]--
+	}
+	scheduler.mutex.Unlock()
+
+	if ok && job.logger != nil {
+		job.logger.Close()
+	}
+}
+
+// labelsMatch reports whether every required label is present on the
+// agent, glob-matched with path.Match (e.g. required "arch=x86_*"
+// matches an agent advertising "arch=x86_64").
+func labelsMatch(agentLabels, required map[string]string) bool {
+	for key, pattern := range required {
+		value, ok := agentLabels[key]
+		if !ok {
+			return false
+		}
+
+		matched, err := path.Match(pattern, value)
+		if err != nil || !matched {
+			return false
+		}
+	}
+
+	return true
+}
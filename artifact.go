@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// ArtifactStore keeps built packages under rootDir, keyed by repo/branch/
+// commit, and maintains a flat pacman repository per repo key alongside
+// them so saturated can be pointed to directly as a pacman server.
+type ArtifactStore struct {
+	rootDir string
+}
+
+func NewArtifactStore(rootDir string) *ArtifactStore {
+	return &ArtifactStore{rootDir: rootDir}
+}
+
+// regenerateRepo links the given packages into the flat repo dir for
+// repoKey and reruns repo-add over it. repo-add itself writes the new
+// database to a temporary file and renames it into place, so clients
+// reading /v1/repo/<repoKey>/ never observe a half-written db.
+func (store *ArtifactStore) regenerateRepo(repoKey string, packages []string) error {
+	repoDir := filepath.Join(store.rootDir, repoKey)
+
+	err := os.MkdirAll(repoDir, 0755)
+	if err != nil {
+		return fmt.Errorf("can't create repo dir: %s", err)
+	}
+
+	linked := make([]string, 0, len(packages))
+	for _, pkg := range packages {
+		link := filepath.Join(repoDir, filepath.Base(pkg))
+
+		os.Remove(link)
+
+		err = os.Link(pkg, link)
+		if err != nil {
+			return fmt.Errorf("can't link package '%s' into repo: %s", pkg, err)
+		}
+
+		linked = append(linked, link)
+	}
+
+	dbPath := filepath.Join(repoDir, repoKey+".db.tar.gz")
+
+	cmd := exec.Command("repo-add", append([]string{dbPath}, linked...)...)
+	cmd.Dir = repoDir
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("repo-add failed: %s: %s", err, output)
+	}
+
+	return nil
+}
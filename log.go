@@ -1,70 +1,303 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
-type PrefixLogger struct {
-	output io.WriteCloser
-	prefix string
+// Level is a logging severity, ordered from most to least verbose.
+type Level int
+
+const (
+	LevelTrace Level = iota
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func ParseLevel(value string) (Level, error) {
+	switch strings.ToLower(value) {
+	case "trace":
+		return LevelTrace, nil
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level '%s'", value)
+	}
 }
 
-type NilCloser struct {
-	io.Writer
+func (level Level) String() string {
+	switch level {
+	case LevelTrace:
+		return "trace"
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
 }
 
-func (closer NilCloser) Close() error {
-	return nil
+// Fields are structured key/value pairs attached to a log entry.
+type Fields map[string]interface{}
+
+// Entry is a single emitted log line.
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  Fields
 }
 
-func (logger PrefixLogger) Write(data []byte) (int, error) {
-	prefixedData := regexp.MustCompile(`(?m)^`).ReplaceAllLiteral(
-		bytes.TrimRight(data, "\n"),
-		[]byte(logger.prefix),
-	)
+// Sink renders entries to an underlying writer, as human-readable text
+// or as NDJSON.
+type Sink interface {
+	Emit(Entry)
+}
 
-	_, err := logger.output.Write(prefixedData)
-	if err != nil {
-		return 0, err
+// Logger is an hclog-style leveled logger: entries below the configured
+// level are dropped, and With returns a child logger whose fields are
+// merged into everything it logs.
+type Logger struct {
+	sink   Sink
+	level  Level
+	fields Fields
+}
+
+func NewLogger(sink Sink, level Level) *Logger {
+	return &Logger{sink: sink, level: level}
+}
+
+func (logger *Logger) With(fields Fields) *Logger {
+	return &Logger{
+		sink:   logger.sink,
+		level:  logger.level,
+		fields: mergeFields(logger.fields, fields),
+	}
+}
+
+func mergeFields(base, extra Fields) Fields {
+	if len(base) == 0 && len(extra) == 0 {
+		return nil
+	}
+
+	merged := make(Fields, len(base)+len(extra))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range extra {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+func (logger *Logger) log(level Level, message string, fields []Fields) {
+	if level < logger.level {
+		return
+	}
+
+	var extra Fields
+	if len(fields) > 0 {
+		extra = fields[0]
+	}
+
+	logger.sink.Emit(Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Message: message,
+		Fields:  mergeFields(logger.fields, extra),
+	})
+}
+
+func (logger *Logger) Trace(message string, fields ...Fields) {
+	logger.log(LevelTrace, message, fields)
+}
+
+func (logger *Logger) Debug(message string, fields ...Fields) {
+	logger.log(LevelDebug, message, fields)
+}
+
+func (logger *Logger) Info(message string, fields ...Fields) {
+	logger.log(LevelInfo, message, fields)
+}
+
+func (logger *Logger) Warn(message string, fields ...Fields) {
+	logger.log(LevelWarn, message, fields)
+}
+
+func (logger *Logger) Error(message string, fields ...Fields) {
+	logger.log(LevelError, message, fields)
+}
+
+// LineWriter returns an io.WriteCloser that splits whatever is written
+// to it into lines and emits each one at Info, with fields merged in --
+// used to stream a command's stdout/stderr, or a remote agent's
+// proxied build log, line by line.
+func (logger *Logger) LineWriter(fields Fields) io.WriteCloser {
+	return &lineWriter{logger: logger, fields: fields}
+}
+
+type lineWriter struct {
+	logger *Logger
+	fields Fields
+	buffer bytes.Buffer
+}
+
+func (writer *lineWriter) Write(data []byte) (int, error) {
+	writer.buffer.Write(data)
+
+	for {
+		line, err := writer.buffer.ReadString('\n')
+		if err != nil {
+			writer.buffer.WriteString(line)
+			break
+		}
+
+		writer.logger.Info(strings.TrimRight(line, "\n"), writer.fields)
 	}
 
 	return len(data), nil
 }
 
-func (logger PrefixLogger) WithPrefix(prefix string) PrefixLogger {
-	logger.prefix = prefix
-	return logger
+func (writer *lineWriter) Close() error {
+	if writer.buffer.Len() > 0 {
+		writer.logger.Info(writer.buffer.String(), writer.fields)
+		writer.buffer.Reset()
+	}
+
+	return nil
+}
+
+// TextSink renders entries as human-readable lines: phase fields
+// become a "[phase] " prefix, everything else is appended as
+// "key=value".
+type TextSink struct {
+	output io.Writer
+}
+
+func NewTextSink(output io.Writer) *TextSink {
+	return &TextSink{output: output}
+}
+
+func (sink *TextSink) Emit(entry Entry) {
+	fmt.Fprintf(sink.output, "%s\n", formatText(entry))
+}
+
+func formatText(entry Entry) string {
+	prefix := "* "
+	if phase, ok := entry.Fields["phase"]; ok {
+		prefix = fmt.Sprintf("[%v] ", phase)
+	}
+
+	line := prefix + entry.Message
+
+	var extra []string
+	for _, key := range sortedFieldKeys(entry.Fields) {
+		if key == "phase" {
+			continue
+		}
+
+		extra = append(extra, fmt.Sprintf("%s=%v", key, entry.Fields[key]))
+	}
+
+	if len(extra) > 0 {
+		line += " (" + strings.Join(extra, " ") + ")"
+	}
+
+	return line
+}
+
+func sortedFieldKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
 }
 
-func (logger PrefixLogger) Close() error {
-	return logger.output.Close()
+// JSONSink renders entries as newline-delimited JSON, one object per
+// line, so CI tooling can parse build progress reliably.
+type JSONSink struct {
+	output io.Writer
 }
 
+func NewJSONSink(output io.Writer) *JSONSink {
+	return &JSONSink{output: output}
+}
+
+func (sink *JSONSink) Emit(entry Entry) {
+	record := make(map[string]interface{}, len(entry.Fields)+3)
+	for key, value := range entry.Fields {
+		record[key] = value
+	}
+
+	record["time"] = entry.Time.Format(time.RFC3339Nano)
+	record["level"] = entry.Level.String()
+	record["message"] = entry.Message
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	sink.output.Write(append(data, '\n'))
+}
+
+// MultiSink fans an entry out to every sink in the slice, e.g. the
+// console and an HTTP response at once.
+type MultiSink []Sink
+
+func (sinks MultiSink) Emit(entry Entry) {
+	for _, sink := range sinks {
+		sink.Emit(entry)
+	}
+}
+
+// LineFlushLogger scans whatever is written to it for complete lines
+// and flushes the underlying HTTP response after writing each one, so
+// a streaming build log shows up in the client in realtime.
 type LineFlushLogger struct {
 	mutex   *sync.Mutex
 	output  io.Writer
 	flusher http.Flusher
-	buffer  bytes.Buffer
+	buffer  *bytes.Buffer
 }
 
 func NewLineFlushLogger(
 	flusher http.Flusher, output io.Writer,
-) LineFlushLogger {
-	return LineFlushLogger{
+) *LineFlushLogger {
+	return &LineFlushLogger{
 		output:  output,
 		flusher: flusher,
 		mutex:   &sync.Mutex{},
+		buffer:  &bytes.Buffer{},
 	}
 }
 
-func (logger LineFlushLogger) Write(data []byte) (int, error) {
+func (logger *LineFlushLogger) Write(data []byte) (int, error) {
 	_, err := logger.buffer.Write(data)
 	if err != nil {
 		return 0, err
@@ -78,15 +311,18 @@ func (logger LineFlushLogger) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
-func (logger LineFlushLogger) Flush() error {
+func (logger *LineFlushLogger) Flush() error {
 	logger.mutex.Lock()
 	defer logger.mutex.Unlock()
 
-	scanner := bufio.NewScanner(&logger.buffer)
-	for scanner.Scan() {
-		line := scanner.Bytes()
+	for {
+		line, err := logger.buffer.ReadString('\n')
+		if err != nil {
+			logger.buffer.WriteString(line)
+			break
+		}
 
-		_, err := logger.output.Write([]byte(string(line) + "\n"))
+		_, err = logger.output.Write([]byte(line))
 		if err != nil {
 			return err
 		}
@@ -97,14 +333,25 @@ func (logger LineFlushLogger) Flush() error {
 	return nil
 }
 
-func (logger LineFlushLogger) Close() error {
-	return logger.Flush()
-}
+// Close flushes whatever partial, not-yet-newline-terminated line
+// remains in the buffer, so the very last line of a log isn't dropped
+// just because it has no trailing newline.
+func (logger *LineFlushLogger) Close() error {
+	logger.mutex.Lock()
+	remainder := logger.buffer.String()
+	logger.buffer.Reset()
+	logger.mutex.Unlock()
 
-type ConsoleLog struct{}
+	if remainder == "" {
+		return nil
+	}
+
+	_, err := logger.output.Write([]byte(remainder))
+	if err != nil {
+		return err
+	}
 
-func (logger ConsoleLog) Write(data []byte) (int, error) {
-	log.Println(strings.TrimRight(string(data), "\n"))
+	logger.flusher.Flush()
 
-	return len(data), nil
+	return nil
 }
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"container/ring"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,7 +15,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"text/tabwriter"
 	"time"
@@ -30,9 +31,19 @@ type HTTPHandler struct {
 	installCommand string
 	branchName     string
 	queue          *BuildQueue
+	artifacts      *ArtifactStore
+	trigger        *TriggerManager
+	scheduler      *AgentScheduler
 
-	lastBuild      *ring.Ring
-	buildListMutex sync.Mutex
+	logLevel    Level
+	logFormat   string
+	consoleSink Sink
+	buildSeq    int64
+
+	store       *BuildStore
+	maxLogBytes int64
+
+	scheduleTimeout time.Duration
 }
 
 type RepoExistError struct {
@@ -40,11 +51,16 @@ type RepoExistError struct {
 }
 
 type BuildInfo struct {
+	id         string
 	repository string
+	trigger    string
 	startedAt  time.Time
 	finishedAt time.Time
 	status     string
 	error      string
+
+	truncated bool
+	cancel    context.CancelFunc
 }
 
 func (info BuildInfo) Duration() time.Duration {
@@ -60,7 +76,56 @@ const apiSummary = `
     * /v1/build/<repo-url>
 
       - GET: clone specified repo, build package and run install command;
-        output logs in realtime.
+        output logs in realtime. Streams human-readable text by
+        default, or NDJSON if "Accept: application/x-ndjson" is sent.
+
+    * /v1/builds
+
+      - GET: list recent builds. Returns the same tabular text/plain
+        output as before by default, or JSON if "Accept:
+        application/json" is sent.
+
+    * /v1/builds/<id>
+
+      - GET: a single build's metadata, as JSON.
+      - DELETE: cancel the build, if it is still running locally.
+
+    * /v1/builds/<id>/log
+
+      - GET: replay the build's persisted log. Add "?follow=1" to keep
+        the connection open and stream new log lines as they're
+        written, for as long as the build keeps running.
+
+    * /v1/repo/<name>/
+
+      - GET: serve the pacman repo database, files db, signatures and
+        package files produced by builds of <name>, so pacman can use
+        saturated as a repo server directly.
+
+    * /v1/hook/<provider>
+
+      - POST: webhook endpoint for github/gitea/gitlab, triggers a build
+        for the pushed repo/ref if the request is signed with the
+        configured per-provider secret.
+
+    * /v1/agents
+
+      - POST: register (or heartbeat) a saturated-agent process with a
+        shared token, labels and a concurrency limit.
+
+    * /v1/agents/claim
+
+      - GET: long-poll endpoint used by agents to claim the next queued
+        build matching their labels.
+
+    * /v1/agents/jobs/<id>/log
+
+      - PUT: agent streams a claimed build's log here; proxied live to
+        whichever client is watching that build.
+
+    * /v1/agents/jobs/<id>/result
+
+      - POST: agent reports a claimed build's final status.
 
     * /v1/key/
 
@@ -87,10 +152,41 @@ Options:
     -b <branch>   Branch, that will be used for checkout. This branch should
                   contain PKGBUILD file.
                   [default: pkgbuild]
-    -k <count>    Maximum builds count to keep in ring buffer.
+    -k <count>    Maximum number of recent builds to keep listed in
+                  memory. Older builds' metadata and logs remain on disk
+                  under -s and are still reachable by ID.
                   [default: 20]
     -u <user>     Run build command with privileges of specified user.
                   [default: nobody]
+    -a <path>     Directory to keep built packages and pacman repo
+                  databases in, served at /v1/repo/<name>/. Artifact
+                  retention is disabled if not given.
+    -c <config>   JSON config file with webhook secrets and polled
+                  mirrors, enabling automatic builds. See TriggerConfig
+                  for the expected shape. Disabled if not given.
+    -t <token>    Shared token remote saturated-agent processes must
+                  present to /v1/agents and /v1/agents/claim. Enables
+                  distributed builds via labels=key=val in
+                  /v1/build/<repo-url> if given.
+    -l <format>   Log format for console output and persisted build
+                  logs: "text" or "json".
+                  [default: text]
+    -L <level>    Minimum log level to emit: trace, debug, info, warn
+                  or error.
+                  [default: info]
+    -s <dir>      Directory to persist build metadata and logs in, so
+                  /v1/builds/<id> and /v1/builds/<id>/log survive a
+                  restart.
+                  [default: /var/lib/saturated/builds]
+    -g <bytes>    Maximum size of a single build's persisted log, in
+                  bytes, before it is truncated. The build keeps running
+                  past the cap, but is reported as "log-truncated".
+                  [default: 10485760]
+    -T <seconds>  How long a distributed build (-t, labels=key=val) waits
+                  for a matching agent to claim and finish it before
+                  failing, so a client isn't blocked forever by a label
+                  nothing matches or a dead agent.
+                  [default: 300]
     -h --help     Show this help.
     -v --version  Show version.
 `
@@ -111,11 +207,48 @@ func main() {
 		maxBuildCountString = args["-k"].(string)
 	)
 
+	var artifactsPath string
+	if args["-a"] != nil {
+		artifactsPath = args["-a"].(string)
+	}
+
+	var configPath string
+	if args["-c"] != nil {
+		configPath = args["-c"].(string)
+	}
+
+	var agentToken string
+	if args["-t"] != nil {
+		agentToken = args["-t"].(string)
+	}
+
+	logFormat := args["-l"].(string)
+	if logFormat != "text" && logFormat != "json" {
+		log.Fatalf("unknown log format '%s', want 'text' or 'json'", logFormat)
+	}
+
+	logLevel, err := ParseLevel(args["-L"].(string))
+	if err != nil {
+		log.Fatalf("can't parse log level: %s", err)
+	}
+
 	maxBuildCount, err := strconv.Atoi(maxBuildCountString)
 	if err != nil {
 		log.Fatalf("can't parse max builds count: %s", err)
 	}
 
+	storeDir := args["-s"].(string)
+
+	maxLogBytes, err := strconv.ParseInt(args["-g"].(string), 10, 64)
+	if err != nil {
+		log.Fatalf("can't parse max log bytes: %s", err)
+	}
+
+	scheduleTimeoutSeconds, err := strconv.Atoi(args["-T"].(string))
+	if err != nil {
+		log.Fatalf("can't parse schedule timeout: %s", err)
+	}
+
 	buildUser, err := user.Lookup(buildUserName)
 	if err != nil {
 		log.Fatalf("can't lookup user '%s': %s", buildUserName, err)
@@ -135,8 +268,49 @@ func main() {
 		installCommand: installCommand,
 		branchName:     branchName,
 		queue:          NewBuildQueue(),
+		buildUid:       buildUid,
+		logLevel:       logLevel,
+		logFormat:      logFormat,
+		maxLogBytes:    maxLogBytes,
 
-		lastBuild: ring.New(maxBuildCount),
+		scheduleTimeout: time.Duration(scheduleTimeoutSeconds) * time.Second,
+	}
+
+	handler.consoleSink = handler.newSink(os.Stdout)
+
+	handler.store, err = NewBuildStore(storeDir, maxBuildCount)
+	if err != nil {
+		log.Fatalf("can't open build store '%s': %s", storeDir, err)
+	}
+
+	// Continue numbering after the highest build ID already on disk, so
+	// a restart doesn't reuse IDs and overwrite earlier builds' records.
+	metaFiles, _ := filepath.Glob(filepath.Join(storeDir, "*.json"))
+	for _, metaFile := range metaFiles {
+		id, err := strconv.ParseInt(
+			strings.TrimSuffix(filepath.Base(metaFile), ".json"), 10, 64,
+		)
+		if err == nil && id > handler.buildSeq {
+			handler.buildSeq = id
+		}
+	}
+
+	if artifactsPath != "" {
+		handler.artifacts = NewArtifactStore(artifactsPath)
+	}
+
+	if configPath != "" {
+		triggerConfig, err := LoadTriggerConfig(configPath)
+		if err != nil {
+			log.Fatalf("can't load config '%s': %s", configPath, err)
+		}
+
+		handler.trigger = NewTriggerManager(handler, triggerConfig)
+		handler.trigger.StartPolling()
+	}
+
+	if agentToken != "" {
+		handler.scheduler = NewAgentScheduler(agentToken)
 	}
 
 	log.Printf("listening on '%s'...", listenAddress)
@@ -175,9 +349,33 @@ func (handler *HTTPHandler) ServeHTTP(
 	case strings.TrimSuffix(url, "/") == "/v1/builds":
 		handler.serveRequestListBuilds(response, request)
 
+	case strings.HasSuffix(url, "/log") && strings.HasPrefix(url, "/v1/builds/"):
+		handler.serveRequestBuildLog(response, request)
+
+	case strings.HasPrefix(url, "/v1/builds/"):
+		handler.serveRequestBuildDetail(response, request)
+
 	case strings.HasPrefix(url, "/v1/build/"):
 		handler.serveRequestBuild(response, request)
 
+	case strings.HasPrefix(url, "/v1/repo/"):
+		handler.serveRequestRepo(response, request)
+
+	case strings.HasPrefix(url, "/v1/hook/"):
+		handler.serveRequestHook(response, request)
+
+	case strings.TrimSuffix(url, "/") == "/v1/agents":
+		handler.serveRequestAgentRegister(response, request)
+
+	case strings.TrimSuffix(url, "/") == "/v1/agents/claim":
+		handler.serveRequestAgentClaim(response, request)
+
+	case strings.HasSuffix(url, "/log") && strings.HasPrefix(url, "/v1/agents/jobs/"):
+		handler.serveRequestAgentJobLog(response, request)
+
+	case strings.HasSuffix(url, "/result") && strings.HasPrefix(url, "/v1/agents/jobs/"):
+		handler.serveRequestAgentJobResult(response, request)
+
 	case strings.TrimSuffix(url, "/") == "/v1/key":
 		handler.serveRequestKey(response, request)
 
@@ -202,111 +400,428 @@ func (handler *HTTPHandler) serveRequestBuild(
 		return
 	}
 
-	logger := PrefixLogger{
-		output: NewLineFlushLogger(
-			response.(http.Flusher),
-			io.MultiWriter(
-				PrefixLogger{
-					prefix: fmt.Sprintf("(%s) ", request.RemoteAddr),
-					output: NilCloser{ConsoleLog{}},
-				},
-				response,
-			),
-		),
-	}
-
-	topLevelLogger := logger.WithPrefix("* ")
-
-	queueSize := handler.queue.GetSize(repoURL)
-	if queueSize > 0 {
-		fmt.Fprintf(
-			topLevelLogger, "you are %d in the build queue", queueSize,
-		)
-
-	}
-
-	handler.queue.Seize(repoURL)
-
-	defer handler.queue.Free(repoURL)
-
-	fmt.Fprintf(topLevelLogger, "running build task for '%s'", repoURL)
-
 	err := request.ParseForm()
 	if err != nil {
 		response.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(topLevelLogger, "error parsing request: %s", err)
+		io.WriteString(response, fmt.Sprintf("error parsing request: %s", err))
 		return
 	}
 
 	environ := request.Form["environ"]
 
-	buildInfo := &BuildInfo{
-		repository: repoURL,
-		startedAt:  time.Now(),
-		status:     "in progress",
+	labels, err := parseLabelConstraints(request.Form["labels"])
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		io.WriteString(response, fmt.Sprintf("invalid labels: %s", err))
+		return
 	}
 
-	handler.saveNewBuild(buildInfo)
-
-	runtime.LockOSThread()
+	buildID := handler.nextBuildID()
 
-	fmt.Fprintf(topLevelLogger, "changing uid to %d", handler.buildUid)
+	buildInfo := handler.store.Create(buildID, repoURL, "manual")
 
-	err = rawSeteuid(handler.buildUid)
+	logger, closeLog, err := handler.buildLogger(request, response, buildID)
 	if err != nil {
 		response.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(
-			topLevelLogger, "can't set uid to %d: %s", handler.buildUid, err,
-		)
+		io.WriteString(response, fmt.Sprintf("can't open build log: %s", err))
 		return
 	}
+	defer closeLog()
+
+	logger = logger.With(Fields{"remote_addr": request.RemoteAddr})
+
+	queueSize := handler.queue.GetSize(repoURL)
+	if queueSize > 0 {
+		logger.Info(fmt.Sprintf("you are %d in the build queue", queueSize))
+	}
+
+	handler.queue.Seize(repoURL)
 
-	err = runBuild(
-		repoURL,
-		handler.reposPath,
-		handler.branchName,
-		handler.buildCommand,
-		handler.installCommand,
-		logger,
-		environ,
+	defer handler.queue.Free(repoURL)
+
+	logger.Info(fmt.Sprintf("running build task for '%s'", repoURL))
+
+	buildLogger := logger.With(
+		Fields{"repo": repoURL, "branch": handler.branchName, "build_id": buildID},
 	)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if len(labels) > 0 {
+		buildLogger.Info(fmt.Sprintf("waiting for an agent matching %v", labels))
+
+		err = handler.runDistributedBuild(repoURL, labels, buildLogger, environ)
+	} else {
+		buildInfo.cancel = cancel
+
+		buildLogger.Info(fmt.Sprintf("changing uid to %d", handler.buildUid))
+
+		err = handler.dropPrivileges()
+		if err == nil {
+			err = runBuild(
+				ctx,
+				repoURL,
+				handler.reposPath,
+				handler.branchName,
+				handler.buildCommand,
+				handler.installCommand,
+				handler.artifacts,
+				buildID,
+				buildLogger,
+				environ,
+			)
+		}
+	}
+
 	buildInfo.finishedAt = time.Now()
 
-	if err != nil {
-		fmt.Fprintf(topLevelLogger, "error during build: %s", err)
+	switch {
+	case ctx.Err() == context.Canceled:
+		logger.Error("build cancelled")
+		buildInfo.status = "cancelled"
+		response.WriteHeader(http.StatusBadRequest)
+
+	case err != nil:
+		logger.Error(fmt.Sprintf("error during build: %s", err))
 		buildInfo.status = "error"
 		buildInfo.error = err.Error()
 
 		response.WriteHeader(http.StatusBadRequest)
-	} else {
-		fmt.Fprintf(topLevelLogger, "build completed")
+
+	default:
+		logger.Info("build completed")
 		buildInfo.status = "success"
 	}
+
+	if buildInfo.truncated && buildInfo.status == "success" {
+		buildInfo.status = "log-truncated"
+	}
+
+	handler.store.Save(buildInfo)
 }
 
+// serveRequestListBuilds lists recent builds, as the tabular text/plain
+// output saturated has always had by default, or as JSON if the client
+// asked for it.
 func (handler *HTTPHandler) serveRequestListBuilds(
 	response http.ResponseWriter, request *http.Request,
 ) {
+	builds := handler.store.List()
+
+	if strings.Contains(request.Header.Get("Accept"), "application/json") {
+		records := make([]buildRecord, len(builds))
+		for i, buildInfo := range builds {
+			records[i] = buildInfo.toRecord()
+		}
+
+		response.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(response).Encode(records)
+
+		return
+	}
+
 	writer := tabwriter.NewWriter(response, 20, 8, 4, ' ', 0)
 	defer writer.Flush()
 
-	fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n",
-		"Repo URL", "Duration", "Status", "Error Message",
+	fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n",
+		"ID", "Repo URL", "Trigger", "Duration", "Status", "Error Message",
 	)
 
-	handler.lastBuild.Do(func(val interface{}) {
-		if val == nil {
+	for _, buildInfo := range builds {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			buildInfo.id, buildInfo.repository, buildInfo.trigger,
+			buildInfo.Duration(), buildInfo.status, buildInfo.error,
+		)
+	}
+}
+
+// serveRequestBuildDetail serves a single build's metadata as JSON, or
+// cancels it if it's still running locally.
+func (handler *HTTPHandler) serveRequestBuildDetail(
+	response http.ResponseWriter, request *http.Request,
+) {
+	id := strings.TrimPrefix(request.URL.Path, "/v1/builds/")
+
+	if request.Method == http.MethodDelete {
+		err := handler.store.Cancel(id)
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		buildInfo := val.(*BuildInfo)
-		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n",
-			buildInfo.repository, buildInfo.Duration(),
-			buildInfo.status, buildInfo.error,
-		)
+		response.WriteHeader(http.StatusOK)
+		return
+	}
+
+	buildInfo, err := handler.store.Get(id)
+	if err != nil {
+		http.NotFound(response, request)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(buildInfo.toRecord())
+}
+
+// serveRequestBuildLog replays a build's persisted log. With
+// "?follow=1" and the build still running, it keeps tailing new bytes
+// as they're written using the same flush-per-line approach as a live
+// /v1/build/<repo-url> response, so a client that dropped off can
+// reconnect here and keep watching.
+func (handler *HTTPHandler) serveRequestBuildLog(
+	response http.ResponseWriter, request *http.Request,
+) {
+	id := strings.TrimPrefix(
+		strings.TrimSuffix(request.URL.Path, "/log"), "/v1/builds/",
+	)
+
+	buildInfo, err := handler.store.Get(id)
+	if err != nil {
+		http.NotFound(response, request)
+		return
+	}
+
+	file, err := os.Open(handler.store.LogPath(id))
+	if err != nil {
+		http.NotFound(response, request)
+		return
+	}
+	defer file.Close()
+
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		http.Error(response, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	flushed := NewLineFlushLogger(flusher, response)
+	defer flushed.Close()
+
+	_, err = io.Copy(flushed, file)
+	if err != nil || request.URL.Query().Get("follow") != "1" {
+		return
+	}
+
+	for buildInfo.finishedAt.IsZero() {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-time.After(time.Second):
+		}
+
+		_, err = io.Copy(flushed, file)
+		if err != nil {
+			return
+		}
+
+		buildInfo, err = handler.store.Get(id)
+		if err != nil {
+			return
+		}
+	}
+
+	io.Copy(flushed, file)
+}
+
+func (handler *HTTPHandler) serveRequestRepo(
+	response http.ResponseWriter, request *http.Request,
+) {
+	if handler.artifacts == nil {
+		http.NotFound(response, request)
+		return
+	}
+
+	http.StripPrefix(
+		"/v1/repo/", http.FileServer(http.Dir(handler.artifacts.rootDir)),
+	).ServeHTTP(response, request)
+}
+
+func (handler *HTTPHandler) serveRequestHook(
+	response http.ResponseWriter, request *http.Request,
+) {
+	if handler.trigger == nil {
+		http.NotFound(response, request)
+		return
+	}
 
+	provider := strings.TrimPrefix(request.URL.Path, "/v1/hook/")
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = handler.trigger.VerifyWebhook(provider, request.Header, body)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	repoURL, branch, err := parseWebhookPayload(provider, body)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	handler.enqueueTriggeredBuild(repoURL, branch, "hook:"+provider)
+
+	response.WriteHeader(http.StatusAccepted)
+}
+
+type agentRegistration struct {
+	ID          string            `json:"id"`
+	Token       string            `json:"token"`
+	Labels      map[string]string `json:"labels"`
+	Concurrency int               `json:"concurrency"`
+}
+
+// serveRequestAgentRegister registers a saturated-agent, or refreshes
+// its heartbeat and labels if it is already registered -- agents are
+// expected to re-POST here periodically, well within agentHeartbeatTTL,
+// or they are evicted and stop being offered jobs.
+func (handler *HTTPHandler) serveRequestAgentRegister(
+	response http.ResponseWriter, request *http.Request,
+) {
+	if handler.scheduler == nil {
+		http.NotFound(response, request)
+		return
+	}
+
+	var registration agentRegistration
+
+	err := json.NewDecoder(request.Body).Decode(&registration)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !handler.scheduler.Authenticate(registration.Token) {
+		http.Error(response, "invalid agent token", http.StatusUnauthorized)
+		return
+	}
+
+	if registration.ID == "" {
+		http.Error(response, "agent id required", http.StatusBadRequest)
+		return
+	}
+
+	handler.scheduler.Register(&Agent{
+		ID:          registration.ID,
+		Labels:      registration.Labels,
+		Concurrency: registration.Concurrency,
 	})
+
+	response.WriteHeader(http.StatusOK)
+}
+
+// serveRequestAgentClaim long-polls until a job matching the agent's
+// labels is queued, then hands it the job descriptor as JSON.
+func (handler *HTTPHandler) serveRequestAgentClaim(
+	response http.ResponseWriter, request *http.Request,
+) {
+	if handler.scheduler == nil {
+		http.NotFound(response, request)
+		return
+	}
+
+	query := request.URL.Query()
+
+	if !handler.scheduler.Authenticate(query.Get("token")) {
+		http.Error(response, "invalid agent token", http.StatusUnauthorized)
+		return
+	}
+
+	agentID := query.Get("id")
+	if agentID == "" {
+		http.Error(response, "id required", http.StatusBadRequest)
+		return
+	}
+
+	job := handler.scheduler.Claim(agentID, 30*time.Second)
+	if job == nil {
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(response).Encode(job)
+}
+
+func jobIDFromPath(url, suffix string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(url, "/v1/agents/jobs/"), suffix)
+}
+
+// serveRequestAgentJobLog proxies an agent's chunked log upload for a
+// claimed job straight into whatever is reading that job's log, e.g. the
+// HTTP client blocked on /v1/build/<repo-url>.
+func (handler *HTTPHandler) serveRequestAgentJobLog(
+	response http.ResponseWriter, request *http.Request,
+) {
+	if handler.scheduler == nil {
+		http.NotFound(response, request)
+		return
+	}
+
+	job := handler.scheduler.Job(jobIDFromPath(request.URL.Path, "/log"))
+	if job == nil {
+		http.NotFound(response, request)
+		return
+	}
+
+	if job.logger != nil {
+		_, err := io.Copy(job.logger, request.Body)
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response.WriteHeader(http.StatusOK)
+}
+
+type jobResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// serveRequestAgentJobResult finalizes a claimed job, unblocking the
+// goroutine that enqueued it with the agent-reported outcome.
+func (handler *HTTPHandler) serveRequestAgentJobResult(
+	response http.ResponseWriter, request *http.Request,
+) {
+	if handler.scheduler == nil {
+		http.NotFound(response, request)
+		return
+	}
+
+	id := jobIDFromPath(request.URL.Path, "/result")
+
+	job := handler.scheduler.Job(id)
+	if job == nil {
+		http.NotFound(response, request)
+		return
+	}
+
+	var result jobResult
+
+	err := json.NewDecoder(request.Body).Decode(&result)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	handler.scheduler.Finish(id)
+
+	if result.Status == "success" {
+		job.done <- nil
+	} else {
+		job.done <- fmt.Errorf("%s", result.Error)
+	}
+
+	response.WriteHeader(http.StatusOK)
 }
 
 func (handler *HTTPHandler) serveRequestKey(
@@ -334,19 +849,22 @@ func (handler *HTTPHandler) serveRoot(
 }
 
 func runBuild(
+	ctx context.Context,
 	repoURL, reposPath, branchName, buildCommand, installCommand string,
-	logger PrefixLogger, environ []string,
+	artifacts *ArtifactStore,
+	buildID string, logger *Logger, environ []string,
 ) error {
-	repoDir := regexp.MustCompile(`[^\w-@.]`).ReplaceAllLiteralString(
-		repoURL, "__",
-	)
+	repoKey := sanitizeIdentifier(repoURL)
 
-	repoPath := filepath.Join(reposPath, repoDir)
+	repoPath := filepath.Join(reposPath, repoKey)
 
 	workDir := repoPath + "%work"
 
 	task := &Task{
-		logger:  logger,
+		ctx: ctx,
+		logger: logger.With(
+			Fields{"repo": repoKey, "branch": branchName, "build_id": buildID},
+		),
 		workDir: workDir,
 	}
 
@@ -355,23 +873,253 @@ func runBuild(
 		return fmt.Errorf("can't update mirror: %s", err)
 	}
 
-	err = task.run(
-		repoPath, branchName, buildCommand, installCommand, environ,
+	var artifactsDir string
+	if artifacts != nil {
+		artifactsDir = artifacts.rootDir
+	}
+
+	packages, err := task.run(
+		repoKey, repoPath, branchName, buildCommand, installCommand,
+		artifactsDir, environ,
 	)
 	if err != nil {
 		return fmt.Errorf("can't install package: %s", err)
 	}
 
+	if artifacts != nil && len(packages) > 0 {
+		err = artifacts.regenerateRepo(repoKey, packages)
+		if err != nil {
+			return fmt.Errorf("can't update pacman repo: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// runDistributedBuild enqueues a job for repoURL on the agent
+// scheduler and blocks until some matching agent claims, runs and
+// reports on it, proxying its log into logger as it arrives. If no
+// agent claims and finishes the job within handler.scheduleTimeout, the
+// job is expired and an error is returned instead of blocking forever.
+func (handler *HTTPHandler) runDistributedBuild(
+	repoURL string, labels map[string]string, logger *Logger, environ []string,
+) error {
+	if handler.scheduler == nil {
+		return fmt.Errorf("no agents configured, can't schedule by labels")
+	}
+
+	job := &Job{
+		RepoURL:        repoURL,
+		BranchName:     handler.branchName,
+		BuildCommand:   handler.buildCommand,
+		InstallCommand: handler.installCommand,
+		Environ:        environ,
+		Labels:         labels,
+		logger:         logger.LineWriter(Fields{"phase": "agent"}),
+		done:           make(chan error, 1),
+	}
+
+	handler.scheduler.Enqueue(job)
+
+	select {
+	case err := <-job.done:
+		return err
+
+	case <-time.After(handler.scheduleTimeout):
+		handler.scheduler.Expire(job)
+		return fmt.Errorf(
+			"no agent claimed and finished this build within %s", handler.scheduleTimeout,
+		)
+	}
+}
+
+// parseLabelConstraints turns "labels=key=val" form fields into a
+// key/pattern map, where pattern is matched against an agent's
+// advertised label value with path.Match (so "arch=x86_*" matches).
+func parseLabelConstraints(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	constraints := map[string]string{}
+
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("malformed label '%s', want key=val", value)
+		}
+
+		constraints[parts[0]] = parts[1]
+	}
+
+	return constraints, nil
+}
+
+// sanitizeIdentifier turns a repo URL (or other free-form string) into
+// something safe to use as a directory name, mirroring the repoDir
+// scheme used for mirrors on disk.
+func sanitizeIdentifier(value string) string {
+	return regexp.MustCompile(`[^\w-@.]`).ReplaceAllLiteralString(value, "__")
+}
+
+// newSink builds a Sink over output in the configured log format.
+func (handler *HTTPHandler) newSink(output io.Writer) Sink {
+	if handler.logFormat == "json" {
+		return NewJSONSink(output)
+	}
+
+	return NewTextSink(output)
+}
+
+// nextBuildID returns a process-unique, monotonically increasing build
+// ID used to correlate a build's log lines and its BuildInfo entry.
+func (handler *HTTPHandler) nextBuildID() string {
+	return strconv.FormatInt(atomic.AddInt64(&handler.buildSeq, 1), 10)
+}
+
+func acceptsNDJSON(request *http.Request) bool {
+	return strings.Contains(request.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// buildLogger returns a logger that fans build log entries out to the
+// console (in the configured format) and to response (text by default,
+// NDJSON if the client asked for it), flushing after every line.
+func (handler *HTTPHandler) buildLogger(
+	request *http.Request, response http.ResponseWriter, buildID string,
+) (*Logger, func() error, error) {
+	logFile, closeLog, err := handler.openLogSink(buildID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	flushed := NewLineFlushLogger(response.(http.Flusher), response)
+
+	var responseSink Sink
+	if acceptsNDJSON(request) {
+		responseSink = NewJSONSink(flushed)
+	} else {
+		responseSink = NewTextSink(flushed)
+	}
+
+	logger := NewLogger(
+		MultiSink{handler.consoleSink, logFile, responseSink}, handler.logLevel,
+	)
+
+	return logger, closeLog, nil
+}
+
+// openLogSink opens the persisted log file for a build, capped at
+// handler.maxLogBytes, and returns it as a Sink in the configured log
+// format alongside its closer.
+func (handler *HTTPHandler) openLogSink(buildID string) (Sink, func() error, error) {
+	writer, err := handler.store.OpenLogWriter(
+		buildID, handler.maxLogBytes,
+		func() { handler.store.MarkTruncated(buildID) },
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return handler.newSink(writer), writer.Close, nil
+}
+
+// dropPrivileges locks the calling goroutine to its OS thread and seteuids
+// it to handler.buildUid, so build commands run with the privileges of the
+// configured build user regardless of which path triggered the build.
+func (handler *HTTPHandler) dropPrivileges() error {
+	runtime.LockOSThread()
+
+	err := rawSeteuid(handler.buildUid)
+	if err != nil {
+		return fmt.Errorf("can't set uid to %d: %s", handler.buildUid, err)
+	}
+
 	return nil
 }
 
-func (handler *HTTPHandler) saveNewBuild(buildInfo *BuildInfo) {
-	handler.buildListMutex.Lock()
-	defer handler.buildListMutex.Unlock()
+// enqueueTriggeredBuild runs a build in the background for an
+// automatically discovered repo/branch (from a webhook or a poll),
+// persisting its log to the build store instead of an HTTP response,
+// and reachable afterwards at /v1/builds/<id>.
+func (handler *HTTPHandler) enqueueTriggeredBuild(repoURL, branch, trigger string) {
+	go func() {
+		branchName := branch
+		if branchName == "" {
+			branchName = handler.branchName
+		}
+
+		buildID := handler.nextBuildID()
+
+		buildInfo := handler.store.Create(buildID, repoURL, trigger)
+
+		logSink, closeLog, err := handler.openLogSink(buildID)
+		if err != nil {
+			buildInfo.finishedAt = time.Now()
+			buildInfo.status = "error"
+			buildInfo.error = fmt.Sprintf("can't open build log: %s", err)
+			handler.store.Save(buildInfo)
+			return
+		}
+		defer closeLog()
+
+		logger := NewLogger(
+			MultiSink{handler.consoleSink, logSink}, handler.logLevel,
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		buildInfo.cancel = cancel
+
+		err = handler.dropPrivileges()
+		if err != nil {
+			logger.Error(err.Error())
+			buildInfo.finishedAt = time.Now()
+			buildInfo.status = "error"
+			buildInfo.error = err.Error()
+			handler.store.Save(buildInfo)
+			return
+		}
+
+		handler.queue.Seize(repoURL)
+		defer handler.queue.Free(repoURL)
+
+		err = runBuild(
+			ctx,
+			repoURL,
+			handler.reposPath,
+			branchName,
+			handler.buildCommand,
+			handler.installCommand,
+			handler.artifacts,
+			buildID,
+			logger,
+			nil,
+		)
+
+		buildInfo.finishedAt = time.Now()
+
+		switch {
+		case ctx.Err() == context.Canceled:
+			logger.Error("build cancelled")
+			buildInfo.status = "cancelled"
+
+		case err != nil:
+			logger.Error(fmt.Sprintf("error during build: %s", err))
+			buildInfo.status = "error"
+			buildInfo.error = err.Error()
+
+		default:
+			logger.Info("build completed")
+			buildInfo.status = "success"
+		}
+
+		if buildInfo.truncated && buildInfo.status == "success" {
+			buildInfo.status = "log-truncated"
+		}
 
-	// moving backward for LIFO order in list
-	handler.lastBuild = handler.lastBuild.Prev()
-	handler.lastBuild.Value = buildInfo
+		handler.store.Save(buildInfo)
+	}()
 }
 
 func rawSeteuid(uid int) error {
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// buildRecord is the on-disk and over-the-wire JSON representation of a
+// BuildInfo, used both to persist build metadata to disk and to answer
+// GET /v1/builds and /v1/builds/<id>.
+type buildRecord struct {
+	ID         string    `json:"id"`
+	Repository string    `json:"repository"`
+	Trigger    string    `json:"trigger"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (info *BuildInfo) toRecord() buildRecord {
+	return buildRecord{
+		ID:         info.id,
+		Repository: info.repository,
+		Trigger:    info.trigger,
+		StartedAt:  info.startedAt,
+		FinishedAt: info.finishedAt,
+		Status:     info.status,
+		Error:      info.error,
+	}
+}
+
+// BuildStore persists build metadata and logs to disk, one JSON file
+// and one log file per build ID, so a build's metadata and log remain
+// reachable by ID after a restart of saturated itself. It also keeps
+// the most recently started builds in memory, for fast listing and so a
+// running build's context.CancelFunc can be reached by DELETE; that
+// list starts empty after a restart.
+type BuildStore struct {
+	dir     string
+	maxKept int
+
+	mutex  sync.Mutex
+	builds map[string]*BuildInfo
+	order  []string // oldest first
+}
+
+func NewBuildStore(dir string, maxKept int) (*BuildStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BuildStore{
+		dir:     dir,
+		maxKept: maxKept,
+		builds:  map[string]*BuildInfo{},
+	}, nil
+}
+
+// Create registers a new in-progress build and persists its initial
+// metadata.
+func (store *BuildStore) Create(id, repository, trigger string) *BuildInfo {
+	info := &BuildInfo{
+		id:         id,
+		repository: repository,
+		trigger:    trigger,
+		startedAt:  time.Now(),
+		status:     "in progress",
+	}
+
+	store.mutex.Lock()
+	store.builds[id] = info
+	store.order = append(store.order, id)
+	for store.maxKept > 0 && len(store.order) > store.maxKept {
+		delete(store.builds, store.order[0])
+		store.order = store.order[1:]
+	}
+	store.mutex.Unlock()
+
+	store.Save(info)
+
+	return info
+}
+
+// Save persists a build's current metadata to disk, called whenever its
+// status changes.
+func (store *BuildStore) Save(info *BuildInfo) {
+	data, err := json.MarshalIndent(info.toRecord(), "", "  ")
+	if err != nil {
+		return
+	}
+
+	ioutil.WriteFile(store.metaPath(info.id), data, 0644)
+}
+
+func (store *BuildStore) metaPath(id string) string {
+	return filepath.Join(store.dir, id+".json")
+}
+
+// LogPath returns the path of the persisted log file for a build.
+func (store *BuildStore) LogPath(id string) string {
+	return filepath.Join(store.dir, id+".log")
+}
+
+// List returns the in-memory kept builds, most recently started first.
+func (store *BuildStore) List() []*BuildInfo {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	builds := make([]*BuildInfo, len(store.order))
+	for i, id := range store.order {
+		builds[len(store.order)-1-i] = store.builds[id]
+	}
+
+	return builds
+}
+
+// Get returns the build with the given ID, falling back to its
+// persisted metadata on disk if it is no longer held in memory (e.g.
+// after a restart, or because it aged out of the in-memory list).
+func (store *BuildStore) Get(id string) (*BuildInfo, error) {
+	store.mutex.Lock()
+	info, ok := store.builds[id]
+	store.mutex.Unlock()
+
+	if ok {
+		return info, nil
+	}
+
+	data, err := ioutil.ReadFile(store.metaPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("unknown build '%s'", id)
+	}
+
+	var record buildRecord
+
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse build record '%s': %s", id, err)
+	}
+
+	return &BuildInfo{
+		id:         record.ID,
+		repository: record.Repository,
+		trigger:    record.Trigger,
+		startedAt:  record.StartedAt,
+		finishedAt: record.FinishedAt,
+		status:     record.Status,
+		error:      record.Error,
+	}, nil
+}
+
+// Cancel requests that a still-running build stop, by cancelling the
+// context.Context its Task is running with. Returns an error if the
+// build is unknown, already finished, or isn't cancellable -- e.g. it
+// was dispatched to a remote agent, which saturated has no way to kill.
+func (store *BuildStore) Cancel(id string) error {
+	store.mutex.Lock()
+	info, ok := store.builds[id]
+	store.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("unknown build '%s'", id)
+	}
+
+	if !info.finishedAt.IsZero() {
+		return fmt.Errorf("build '%s' already finished", id)
+	}
+
+	if info.cancel == nil {
+		return fmt.Errorf("build '%s' can't be cancelled", id)
+	}
+
+	info.cancel()
+
+	return nil
+}
+
+// MarkTruncated flags a build as having exceeded its configured log
+// size cap. If the build goes on to succeed, its final status is
+// reported as "log-truncated"; a failed or cancelled build keeps its
+// "error" or "cancelled" status.
+func (store *BuildStore) MarkTruncated(id string) {
+	store.mutex.Lock()
+	info, ok := store.builds[id]
+	store.mutex.Unlock()
+
+	if ok {
+		info.truncated = true
+	}
+}
+
+// OpenLogWriter creates the persisted log file for a build, wrapped so
+// that writes past maxBytes are silently dropped rather than filling
+// the disk, with onExceed called once the cap is first hit.
+func (store *BuildStore) OpenLogWriter(
+	id string, maxBytes int64, onExceed func(),
+) (io.WriteCloser, error) {
+	file, err := os.Create(store.LogPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	return &cappedFile{
+		file:   file,
+		writer: newCappedWriter(file, maxBytes, onExceed),
+	}, nil
+}
+
+// cappedWriter writes to an underlying writer up to a byte limit, after
+// which further writes are accepted (so the caller doesn't see an
+// error) but dropped, and onExceed is called exactly once.
+type cappedWriter struct {
+	output    io.Writer
+	remaining int64
+	onExceed  func()
+	exceeded  bool
+}
+
+func newCappedWriter(output io.Writer, maxBytes int64, onExceed func()) *cappedWriter {
+	return &cappedWriter{output: output, remaining: maxBytes, onExceed: onExceed}
+}
+
+func (writer *cappedWriter) Write(data []byte) (int, error) {
+	total := len(data)
+
+	if writer.remaining <= 0 {
+		writer.markExceeded()
+		return total, nil
+	}
+
+	if int64(len(data)) > writer.remaining {
+		data = data[:writer.remaining]
+	}
+
+	n, err := writer.output.Write(data)
+	writer.remaining -= int64(n)
+
+	if writer.remaining <= 0 {
+		writer.markExceeded()
+	}
+
+	return total, err
+}
+
+func (writer *cappedWriter) markExceeded() {
+	if !writer.exceeded {
+		writer.exceeded = true
+		writer.onExceed()
+	}
+}
+
+type cappedFile struct {
+	file   *os.File
+	writer *cappedWriter
+}
+
+func (w *cappedFile) Write(data []byte) (int, error) {
+	return w.writer.Write(data)
+}
+
+func (w *cappedFile) Close() error {
+	return w.file.Close()
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
 type Task struct {
-	logger  PrefixLogger
+	ctx     context.Context
+	logger  *Logger
 	workDir string
 }
 
@@ -30,34 +32,110 @@ func (task *Task) updateMirror(repoURL, repoPath string) error {
 }
 
 func (task *Task) run(
-	repoPath, branchName, buildCommand, installCommand string,
+	repoKey, repoPath, branchName, buildCommand, installCommand,
+	artifactsDir string,
 	environ []string,
-) error {
+) ([]string, error) {
 	defer task.cleanWorkDir()
 
 	err := task.createWorkDir(repoPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = task.checkoutBranch(branchName)
 	if err != nil {
-		return fmt.Errorf("can't checkout branch '%s': %s", branchName, err)
+		return nil, fmt.Errorf("can't checkout branch '%s': %s", branchName, err)
 	}
 
 	err = task.buildPackage(buildCommand, environ)
 	if err != nil {
-		return fmt.Errorf("can't build package: %s", err)
+		return nil, fmt.Errorf("can't build package: %s", err)
 	}
 
 	if installCommand != "" {
 		err = task.installPackage(installCommand)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	var packages []string
+	if artifactsDir != "" {
+		packages, err = task.collectPackages(artifactsDir, repoKey, branchName)
+		if err != nil {
+			return nil, fmt.Errorf("can't collect built packages: %s", err)
+		}
+	}
+
+	return packages, nil
+}
+
+// collectPackages scans the work dir for packages produced by the last
+// build (before cleanWorkDir removes it) and moves them into
+// <artifactsDir>/<repoKey>/<branchName>/<commit>/, keyed by the commit
+// that was actually checked out and built.
+func (task *Task) collectPackages(
+	artifactsDir, repoKey, branchName string,
+) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(task.workDir, "*.pkg.tar.*"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	commit, err := task.currentCommit()
+	if err != nil {
+		return nil, fmt.Errorf("can't determine built commit: %s", err)
+	}
+
+	destDir := filepath.Join(artifactsDir, repoKey, branchName, commit)
+
+	err = os.MkdirAll(destDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := make([]string, 0, len(matches))
+	for _, match := range matches {
+		dest := filepath.Join(destDir, filepath.Base(match))
+
+		err = os.Rename(match, dest)
+		if err != nil {
+			return nil, fmt.Errorf("can't move package '%s': %s", match, err)
+		}
+
+		packages = append(packages, dest)
+	}
+
+	return packages, nil
+}
+
+// branchTip returns the commit a branch currently points to in the
+// mirror at repoPath, used by the polling trigger to detect new commits.
+func (task *Task) branchTip(repoPath, branch string) (string, error) {
+	output, err := exec.CommandContext(
+		task.ctx, "git", "-C", repoPath, "rev-parse", branch,
+	).Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (task *Task) currentCommit() (string, error) {
+	output, err := exec.CommandContext(
+		task.ctx, "git", "-C", task.workDir, "rev-parse", "HEAD",
+	).Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
 }
 
 func (task *Task) clone(repoURL, repoPath string) error {
@@ -66,72 +144,77 @@ func (task *Task) clone(repoURL, repoPath string) error {
 	}
 
 	return runCommandWithLog(
-		exec.Command("git", "clone", "--mirror", repoURL, repoPath),
-		task.logger.WithPrefix("[clone] "),
+		exec.CommandContext(task.ctx, "git", "clone", "--mirror", repoURL, repoPath),
+		task.logger.With(Fields{"phase": "clone"}),
 	)
 }
 
 func (task *Task) fetch(repoPath string) error {
-	cmd := exec.Command("git", "fetch", "-pt", "--all")
+	cmd := exec.CommandContext(task.ctx, "git", "fetch", "-pt", "--all")
 	cmd.Dir = repoPath
 	return runCommandWithLog(
 		cmd,
-		task.logger.WithPrefix("[fetch] "),
+		task.logger.With(Fields{"phase": "fetch"}),
 	)
 }
 
 func (task *Task) createWorkDir(source string) error {
 	return runCommandWithLog(
-		exec.Command("git", "clone", source, task.workDir),
-		task.logger.WithPrefix("[workdir] "),
+		exec.CommandContext(task.ctx, "git", "clone", source, task.workDir),
+		task.logger.With(Fields{"phase": "workdir"}),
 	)
 }
 
 func (task *Task) checkoutBranch(branch string) error {
 	return runCommandWithLog(
-		exec.Command("git", "-C", task.workDir, "checkout", branch),
-		task.logger.WithPrefix("[workdir] "),
+		exec.CommandContext(task.ctx, "git", "-C", task.workDir, "checkout", branch),
+		task.logger.With(Fields{"phase": "workdir"}),
 	)
 }
 
 func (task *Task) cleanWorkDir() error {
-	fmt.Fprintf(
-		task.logger.WithPrefix("[clean] "),
-		"working dir '%s' cleared", task.workDir,
+	task.logger.Info(
+		fmt.Sprintf("working dir '%s' cleared", task.workDir),
+		Fields{"phase": "clean"},
 	)
 
 	return os.RemoveAll(task.workDir)
 }
 
 func (task *Task) buildPackage(commandString string, environ []string) error {
-	command := makeShellCommand(commandString, task.workDir)
+	command := makeShellCommand(task.ctx, commandString, task.workDir)
 	command.Env = append(environ, os.Environ()...)
-	return runCommandWithLog(command, task.logger.WithPrefix("[build] "))
+	return runCommandWithLog(command, task.logger.With(Fields{"phase": "build"}))
 }
 
 func (task *Task) installPackage(command string) error {
 	return runCommandWithLog(
-		makeShellCommand(command, task.workDir),
-		task.logger.WithPrefix("[install] "),
+		makeShellCommand(task.ctx, command, task.workDir),
+		task.logger.With(Fields{"phase": "install"}),
 	)
 }
 
-func runCommandWithLog(command *exec.Cmd, logger io.WriteCloser) error {
-	command.Stdout = logger
-	command.Stderr = logger
+// runCommandWithLog runs command, streaming its stdout and stderr to
+// logger line by line (tagged with a stream field) as it runs.
+func runCommandWithLog(command *exec.Cmd, logger *Logger) error {
+	stdout := logger.LineWriter(Fields{"stream": "stdout"})
+	stderr := logger.LineWriter(Fields{"stream": "stderr"})
+
+	command.Stdout = stdout
+	command.Stderr = stderr
 
 	err := command.Run()
-	if err != nil {
-		return err
-	}
 
-	return logger.Close()
+	stdout.Close()
+	stderr.Close()
+
+	return err
 }
 
 func makeShellCommand(
-	command string, workDir string, args ...string,
+	ctx context.Context, command string, workDir string, args ...string,
 ) *exec.Cmd {
-	cmd := exec.Command("sh", append([]string{"-c", command}, args...)...)
+	cmd := exec.CommandContext(ctx, "sh", append([]string{"-c", command}, args...)...)
 	cmd.Dir = workDir
 	return cmd
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TriggerConfig describes webhook secrets and mirrors to poll, loaded
+// from the file passed via -c.
+type TriggerConfig struct {
+	Webhooks map[string]string `json:"webhooks"`
+	Poll     []PolledRepo      `json:"poll"`
+}
+
+// PolledRepo is a mirror watched for new commits on a single branch.
+type PolledRepo struct {
+	URL      string `json:"url"`
+	Branch   string `json:"branch"`
+	Interval int    `json:"interval_seconds"`
+}
+
+func LoadTriggerConfig(path string) (TriggerConfig, error) {
+	var config TriggerConfig
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("can't parse config: %s", err)
+	}
+
+	return config, nil
+}
+
+// webhookSignatureHeaders maps a provider name, as used in the
+// /v1/hook/<provider> URL, to the header carrying its signature/token.
+var webhookSignatureHeaders = map[string]string{
+	"github": "X-Hub-Signature-256",
+	"gitea":  "X-Gitea-Signature",
+	"gitlab": "X-Gitlab-Token",
+}
+
+// TriggerManager owns the automatic-build subsystem: verifying inbound
+// webhooks and polling configured mirrors for new commits.
+type TriggerManager struct {
+	handler *HTTPHandler
+	config  TriggerConfig
+
+	tips      map[string]string
+	tipsMutex sync.Mutex
+}
+
+func NewTriggerManager(handler *HTTPHandler, config TriggerConfig) *TriggerManager {
+	return &TriggerManager{
+		handler: handler,
+		config:  config,
+		tips:    map[string]string{},
+	}
+}
+
+// VerifyWebhook checks the request against the secret configured for
+// provider. Github/Gitea sign the body with HMAC-SHA256; Gitlab sends a
+// plain shared token instead.
+func (manager *TriggerManager) VerifyWebhook(
+	provider string, header http.Header, body []byte,
+) error {
+	secret, ok := manager.config.Webhooks[provider]
+	if !ok {
+		return fmt.Errorf("unknown webhook provider '%s'", provider)
+	}
+
+	signatureHeader, ok := webhookSignatureHeaders[provider]
+	if !ok {
+		return fmt.Errorf("unsupported webhook provider '%s'", provider)
+	}
+
+	if provider == "gitlab" {
+		if header.Get(signatureHeader) != secret {
+			return fmt.Errorf("invalid gitlab token")
+		}
+
+		return nil
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	digest := hex.EncodeToString(mac.Sum(nil))
+
+	expected := digest
+	if provider == "github" {
+		expected = "sha256=" + digest
+	}
+
+	if !hmac.Equal([]byte(expected), []byte(header.Get(signatureHeader))) {
+		return fmt.Errorf("invalid webhook signature")
+	}
+
+	return nil
+}
+
+// webhookPushPayload covers the fields common to github/gitea/gitlab
+// push event payloads that are needed to start a build.
+type webhookPushPayload struct {
+	Ref        string `json:"ref"`
+	Repository struct {
+		CloneURL   string `json:"clone_url"`
+		GitHTTPURL string `json:"git_http_url"`
+		URL        string `json:"url"`
+	} `json:"repository"`
+}
+
+func parseWebhookPayload(provider string, body []byte) (string, string, error) {
+	var payload webhookPushPayload
+
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return "", "", fmt.Errorf("can't parse %s payload: %s", provider, err)
+	}
+
+	repoURL := payload.Repository.CloneURL
+	if repoURL == "" {
+		repoURL = payload.Repository.GitHTTPURL
+	}
+	if repoURL == "" {
+		repoURL = payload.Repository.URL
+	}
+	if repoURL == "" {
+		return "", "", fmt.Errorf("no repository url in %s payload", provider)
+	}
+
+	branch := strings.TrimPrefix(payload.Ref, "refs/heads/")
+	if branch == "" {
+		return "", "", fmt.Errorf("no ref in %s payload", provider)
+	}
+
+	return repoURL, branch, nil
+}
+
+// StartPolling spawns one goroutine per configured mirror, each
+// periodically fetching and checking whether its watched branch
+// advanced.
+func (manager *TriggerManager) StartPolling() {
+	for _, repo := range manager.config.Poll {
+		go manager.pollRepo(repo)
+	}
+}
+
+func (manager *TriggerManager) pollRepo(repo PolledRepo) {
+	interval := time.Duration(repo.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	for {
+		manager.checkRepo(repo)
+		time.Sleep(interval)
+	}
+}
+
+func (manager *TriggerManager) checkRepo(repo PolledRepo) {
+	repoKey := sanitizeIdentifier(repo.URL)
+	repoPath := filepath.Join(manager.handler.reposPath, repoKey)
+
+	task := &Task{
+		ctx: context.Background(),
+		logger: NewLogger(manager.handler.consoleSink, manager.handler.logLevel).With(
+			Fields{"repo": repoKey, "branch": repo.Branch, "phase": "poll"},
+		),
+		workDir: repoPath + "%work",
+	}
+
+	err := task.updateMirror(repo.URL, repoPath)
+	if err != nil {
+		log.Printf("poll: can't update mirror for '%s': %s", repo.URL, err)
+		return
+	}
+
+	tip, err := task.branchTip(repoPath, repo.Branch)
+	if err != nil {
+		log.Printf(
+			"poll: can't read tip of '%s' on '%s': %s",
+			repo.Branch, repo.URL, err,
+		)
+		return
+	}
+
+	key := repo.URL + "@" + repo.Branch
+
+	manager.tipsMutex.Lock()
+	last, seen := manager.tips[key]
+	manager.tips[key] = tip
+	manager.tipsMutex.Unlock()
+
+	if !seen || last == tip {
+		return
+	}
+
+	manager.handler.enqueueTriggeredBuild(repo.URL, repo.Branch, "poll")
+}